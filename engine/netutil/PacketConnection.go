@@ -8,16 +8,14 @@ import (
 
 	"sync"
 
-	"time"
-
 	"sync/atomic"
 
+	"time"
+
 	"compress/flate"
 
 	"os"
 
-	"io"
-
 	"github.com/pkg/errors"
 	"github.com/xiaonanln/go-xnsyncutil/xnsyncutil"
 	"github.com/xiaonanln/goworld/engine/consts"
@@ -28,8 +26,19 @@ import (
 const (
 	_MAX_PACKET_SIZE    = 25 * 1024 * 1024 // _MAX_PACKET_SIZE is the max size limit of packets in packet connections
 	_SIZE_FIELD_SIZE    = 4                // _SIZE_FIELD_SIZE is the packet size field (uint32) size
-	_PREPAYLOAD_SIZE    = _SIZE_FIELD_SIZE
+	_CHANNEL_ID_SIZE    = 1                // _CHANNEL_ID_SIZE is the 1-byte ChannelID following the size field
+	_PREPAYLOAD_SIZE    = _SIZE_FIELD_SIZE + _CHANNEL_ID_SIZE
 	_MAX_PAYLOAD_LENGTH = _MAX_PACKET_SIZE - _PREPAYLOAD_SIZE
+
+	// the size field is widened to double as a small header: the top bit marks
+	// the packet as compressed, the next _CODEC_ID_BITS bits carry the
+	// CompressionCodec.ID() used for this packet, and the rest is the payload
+	// length.
+	_COMPRESSED_BIT_MASK = uint32(1) << 31
+	_CODEC_ID_BITS       = 4
+	_CODEC_ID_SHIFT      = 31 - _CODEC_ID_BITS
+	_CODEC_ID_MASK       = uint32(1<<_CODEC_ID_BITS-1) << _CODEC_ID_SHIFT
+	_PAYLOAD_LEN_MASK    = uint32(1)<<_CODEC_ID_SHIFT - 1
 )
 
 var (
@@ -52,6 +61,13 @@ func init() {
 	gwlog.Infof("%d compress writer created.", consts.COMPRESS_WRITER_POOL_SIZE)
 }
 
+// defaultCodec is the codec used by NewPacketConnection(conn, true), kept as
+// flate for compatibility with connections that predate the codec system.
+func defaultCodec() CompressionCodec {
+	codec, _ := CodecByID(CodecIDFlate)
+	return codec
+}
+
 type _ErrRecvAgain struct{}
 
 func (err _ErrRecvAgain) Error() string {
@@ -68,35 +84,69 @@ func (err _ErrRecvAgain) Timeout() bool {
 
 // PacketConnection is a connection that send and receive data packets
 type PacketConnection struct {
-	conn               Connection
-	compressed         bool
-	pendingPackets     []*Packet
-	pendingPacketsLock sync.Mutex
-	sendBuffer         *sendBuffer // each PacketConnection uses 1 sendBuffer for sending packets
+	conn         Connection
+	compressed   bool
+	codec        CompressionCodec  // codec used to compress outgoing packets, nil if compressed is false
+	compression  *compressionState // set by NewPacketConnectionWithOptions, nil otherwise
+	bufferPool   BufferPool        // scratch buffers for compress/decompress, see SetBufferPool
+	keepalive    *keepaliveState   // activity tracking; its goroutine starts on SetKeepAlive/SetIdleTimeout
+	onAccept     func(net.Addr) error
+	onAcceptOnce sync.Once
+	sendBuffer   *sendBuffer // each PacketConnection uses 1 sendBuffer for sending packets
+
+	// channels hold per-channel FIFO send queues; channelOrder records
+	// registration order so drainChannelsWRR has a stable iteration order.
+	channels     map[ChannelID]*channelQueue
+	channelOrder []ChannelID
+	channelsLock sync.Mutex
 
 	// buffers and infos for receiving a packet
 	payloadLenBuf         [_SIZE_FIELD_SIZE]byte
 	payloadLenBytesRecved int
+	channelIDBuf          [1]byte
+	channelIDBytesRecved  int
 	recvCompressed        bool
+	recvCodecID           uint8
 	recvTotalPayloadLen   uint32
 	recvedPayloadLen      uint32
 	recvingPacket         *Packet
-
-	compressReader io.ReadCloser
+	lastRecvChannel       ChannelID
 }
 
-// NewPacketConnection creates a packet connection based on network connection
+// NewPacketConnection creates a packet connection based on network connection.
+// When compressed is true, outgoing packets are compressed with flate, kept
+// as the default for backwards compatibility; use NewPacketConnectionWithCodec
+// to pick a different codec.
 func NewPacketConnection(conn Connection, compressed bool) *PacketConnection {
+	var codec CompressionCodec
+	if compressed {
+		codec = defaultCodec()
+	}
+	return NewPacketConnectionWithCodec(conn, codec)
+}
+
+// NewPacketConnectionWithCodec creates a packet connection that compresses
+// outgoing packets with the given codec. Pass a nil codec to disable
+// compression entirely.
+func NewPacketConnectionWithCodec(conn Connection, codec CompressionCodec) *PacketConnection {
 	pc := &PacketConnection{
 		conn:       conn,
 		sendBuffer: newSendBuffer(),
-		compressed: compressed,
+		compressed: codec != nil,
+		codec:      codec,
+		bufferPool: defaultBufferPool,
+		keepalive:  newKeepaliveState(),
 	}
-
-	pc.compressReader = flate.NewReader(os.Stdin) // reader is always needed
 	return pc
 }
 
+// SetPreferredCodec sets the codec used to compress subsequently sent
+// packets. Passing nil disables compression for packets sent afterwards.
+func (pc *PacketConnection) SetPreferredCodec(codec CompressionCodec) {
+	pc.codec = codec
+	pc.compressed = codec != nil
+}
+
 // NewPacket allocates a new packet (usually for sending)
 func (pc *PacketConnection) NewPacket() *Packet {
 	return allocPacket()
@@ -110,49 +160,31 @@ func (pc *PacketConnection) SendPacket(packet *Packet) error {
 			packet.GetPayloadLen(),
 			packet.bytes[_PREPAYLOAD_SIZE+2:_PREPAYLOAD_SIZE+packet.GetPayloadLen()])
 	}
-	if atomic.LoadInt64(&packet.refcount) <= 0 {
-		gwlog.Panicf("sending packet with refcount=%d", packet.refcount)
-	}
-
-	packet.AddRefCount(1)
-	pc.pendingPacketsLock.Lock()
-	pc.pendingPackets = append(pc.pendingPackets, packet)
-	pc.pendingPacketsLock.Unlock()
-	return nil
+	return pc.SendPacketOnChannel(DefaultChannelID, packet)
 }
 
 // Flush connection writes
 func (pc *PacketConnection) Flush(reason string) (err error) {
-	pc.pendingPacketsLock.Lock()
-	if len(pc.pendingPackets) == 0 { // no packets to send, common to happen, so handle efficiently
-		pc.pendingPacketsLock.Unlock()
+	items := pc.drainChannelsWRR()
+	if len(items) == 0 { // no packets to send, common to happen, so handle efficiently
 		return
 	}
-	packets := make([]*Packet, 0, len(pc.pendingPackets))
-	packets, pc.pendingPackets = pc.pendingPackets, packets
-	pc.pendingPacketsLock.Unlock()
 
 	// flush should only be called in one goroutine
 	op := opmon.StartOperation("FlushPackets-" + reason)
 	defer op.Finish(time.Millisecond * 100)
-
-	var cw *flate.Writer
-
-	if len(packets) == 1 {
-		// only 1 packet to send, just send it directly, no need to use send buffer
-		packet := packets[0]
-		if cw == nil && pc.compressed && packet.requireCompress() {
-			_cw := compressWritersPool.TryGet() // try to get a usable compress writer, might fail
-			if _cw != nil {
-				cw = _cw.(*flate.Writer)
-				defer compressWritersPool.Put(cw)
-			} else {
-				gwlog.Warnf("Fail to get compressor, packet is not compressed")
-			}
+	defer func() {
+		if err == nil {
+			pc.markActive()
 		}
+	}()
 
-		if cw != nil {
-			packet.compress(cw)
+	if len(items) == 1 {
+		// only 1 packet to send, just send it directly, no need to use send buffer
+		packet := items[0].packet
+		pc.setChannelID(packet, items[0].channel)
+		if pc.compressed && packet.requireCompress() {
+			pc.compressPacket(packet)
 		}
 		err = WriteAll(pc.conn, packet.data())
 		packet.Release()
@@ -165,20 +197,11 @@ func (pc *PacketConnection) Flush(reason string) (err error) {
 	sendBuffer := pc.sendBuffer // the send buffer
 
 send_packets_loop:
-	for _, packet := range packets {
-		if cw == nil && pc.compressed && packet.requireCompress() {
-			_cw := compressWritersPool.TryGet() // try to get a usable compress writer, might fail
-			if _cw != nil {
-				cw = _cw.(*flate.Writer)
-				//noinspection GoDeferInLoop
-				defer compressWritersPool.Put(cw)
-			} else {
-				gwlog.Warnf("Fail to get compressor, packet is not compressed")
-			}
-		}
-
-		if cw != nil {
-			packet.compress(cw)
+	for _, item := range items {
+		packet := item.packet
+		pc.setChannelID(packet, item.channel)
+		if pc.compressed && packet.requireCompress() {
+			pc.compressPacket(packet)
 		}
 
 		packetData := packet.data()
@@ -221,8 +244,42 @@ func (pc *PacketConnection) SetRecvDeadline(deadline time.Time) error {
 	return pc.conn.SetReadDeadline(deadline)
 }
 
-// RecvPacket receives the next packet
+// RecvPacket receives the next packet, transparently answering and
+// swallowing the internal PING/PONG keepalive packets started by
+// SetKeepAlive/SetIdleTimeout so callers never see them.
 func (pc *PacketConnection) RecvPacket() (*Packet, error) {
+	for {
+		packet, err := pc.recvPacketOnce()
+		if err != nil {
+			return nil, err
+		}
+
+		msgtype := packetEndian.Uint16(packet.bytes[_PREPAYLOAD_SIZE : _PREPAYLOAD_SIZE+2])
+		if msgtype == MsgTypePing {
+			packet.Release()
+			pc.sendPong()
+			continue
+		}
+		if msgtype == MsgTypePong {
+			packet.Release()
+			if pc.keepalive != nil {
+				atomic.StoreInt64(&pc.keepalive.pingSentNano, 0)
+			}
+			continue
+		}
+
+		return packet, nil
+	}
+}
+
+// recvPacketOnce receives the next packet, or io.ErrNoProgress-like
+// errRecvAgain if no full packet is available yet.
+func (pc *PacketConnection) recvPacketOnce() (*Packet, error) {
+	if err := pc.runOnAcceptOnce(); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
 	if pc.payloadLenBytesRecved < _SIZE_FIELD_SIZE {
 		// receive more of payload len bytes
 		n, err := pc.conn.Read(pc.payloadLenBuf[pc.payloadLenBytesRecved:])
@@ -240,6 +297,7 @@ func (pc *PacketConnection) RecvPacket() (*Packet, error) {
 			gwlog.Panicf("should be false")
 		}
 		if pc.recvTotalPayloadLen&_COMPRESSED_BIT_MASK != 0 {
+			pc.recvCodecID = uint8((pc.recvTotalPayloadLen & _CODEC_ID_MASK) >> _CODEC_ID_SHIFT)
 			pc.recvTotalPayloadLen &= _PAYLOAD_LEN_MASK
 			pc.recvCompressed = true
 		}
@@ -250,6 +308,27 @@ func (pc *PacketConnection) RecvPacket() (*Packet, error) {
 			pc.Close()
 			return nil, err
 		}
+	}
+
+	if pc.channelIDBytesRecved < _CHANNEL_ID_SIZE {
+		// receive the 1-byte channel id that follows the size field
+		n, err := pc.conn.Read(pc.channelIDBuf[pc.channelIDBytesRecved:])
+		pc.channelIDBytesRecved += n
+		if pc.channelIDBytesRecved < _CHANNEL_ID_SIZE {
+			if err == nil {
+				err = errRecvAgain
+			}
+			return nil, err // packet not finished yet
+		}
+
+		pc.lastRecvChannel = pc.channelIDBuf[0]
+		if capacity := pc.recvMessageCapacity(pc.lastRecvChannel); pc.recvTotalPayloadLen > capacity {
+			err := errors.Errorf("payload length %v exceeds capacity %v of channel %v",
+				pc.recvTotalPayloadLen, capacity, pc.lastRecvChannel)
+			pc.resetRecvStates()
+			pc.Close()
+			return nil, err
+		}
 
 		pc.recvedPayloadLen = 0
 		pc.recvingPacket = NewPacket()
@@ -263,10 +342,28 @@ func (pc *PacketConnection) RecvPacket() (*Packet, error) {
 	if pc.recvedPayloadLen == pc.recvTotalPayloadLen {
 		// full packet received, return the packet
 		packet := pc.recvingPacket
-		packet.setPayloadLenCompressed(pc.recvTotalPayloadLen, pc.recvCompressed)
+		compressedLen, compressed, codecID := pc.recvTotalPayloadLen, pc.recvCompressed, pc.recvCodecID
 		pc.resetRecvStates()
-		packet.decompress(pc.compressReader)
 
+		if compressed {
+			codec, ok := CodecByID(codecID)
+			if !ok {
+				err := errors.Errorf("unknown compression codec id: %v", codecID)
+				packet.Release()
+				pc.Close()
+				return nil, err
+			}
+			maxLen := pc.recvMessageCapacity(pc.lastRecvChannel)
+			if err := pc.decompressPacket(packet, compressedLen, codec, maxLen); err != nil {
+				packet.Release()
+				pc.Close()
+				return nil, err
+			}
+		} else {
+			packet.setPayloadLenCompressed(compressedLen, false)
+		}
+
+		pc.markActive()
 		return packet, nil
 	}
 
@@ -277,6 +374,7 @@ func (pc *PacketConnection) RecvPacket() (*Packet, error) {
 }
 func (pc *PacketConnection) resetRecvStates() {
 	pc.payloadLenBytesRecved = 0
+	pc.channelIDBytesRecved = 0
 	pc.recvTotalPayloadLen = 0
 	pc.recvedPayloadLen = 0
 	pc.recvingPacket = nil
@@ -285,6 +383,7 @@ func (pc *PacketConnection) resetRecvStates() {
 
 // Close the connection
 func (pc *PacketConnection) Close() error {
+	pc.stopKeepalive()
 	return pc.conn.Close()
 }
 
@@ -0,0 +1,82 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestCIDRListDefaultAndOverrides(t *testing.T) {
+	list := NewCIDRList(false)
+	if err := list.Allow("10.0.0.0/8"); err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	if err := list.Deny("10.1.0.0/16"); err != nil {
+		t.Fatalf("Deny failed: %v", err)
+	}
+
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.2.3.4", true},   // matches the allow entry, not the later deny
+		{"10.1.5.6", true},   // matches the allow entry first (entries checked in order)
+		{"192.168.0.1", false}, // matches nothing, falls back to defaultAllow=false
+	}
+	for _, c := range cases {
+		if got := list.Check(tcpAddr(c.ip)); got != c.want {
+			t.Errorf("Check(%s) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+}
+
+func TestCIDRListOnAcceptRejectsDenied(t *testing.T) {
+	list := NewCIDRList(true)
+	if err := list.Deny("172.16.0.0/12"); err != nil {
+		t.Fatalf("Deny failed: %v", err)
+	}
+	if err := list.OnAccept(tcpAddr("172.16.5.1")); err == nil {
+		t.Fatalf("expected denied address to be rejected")
+	}
+	if err := list.OnAccept(tcpAddr("8.8.8.8")); err != nil {
+		t.Fatalf("expected unmatched address to be allowed, got %v", err)
+	}
+}
+
+func TestLeakyBucketRateLimiterBurstAndRefill(t *testing.T) {
+	rl := NewLeakyBucketRateLimiter(1 /* rate */, 2 /* burst */).(*leakyBucketRateLimiter)
+	addr := tcpAddr("1.2.3.4")
+
+	if !rl.Allow(addr) || !rl.Allow(addr) {
+		t.Fatalf("expected the first burst tokens to be allowed")
+	}
+	if rl.Allow(addr) {
+		t.Fatalf("expected the bucket to be exhausted after burst tokens are spent")
+	}
+
+	// simulate time passing without sleeping in the test
+	rl.mu.Lock()
+	rl.buckets[addrHost(addr)].lastRefill = time.Now().Add(-2 * time.Second)
+	rl.mu.Unlock()
+
+	if !rl.Allow(addr) {
+		t.Fatalf("expected a refilled token to be allowed after the simulated delay")
+	}
+}
+
+func TestLeakyBucketRateLimiterPerIPIsolation(t *testing.T) {
+	rl := NewLeakyBucketRateLimiter(1, 1)
+	a := tcpAddr("1.1.1.1")
+	b := tcpAddr("2.2.2.2")
+
+	if !rl.Allow(a) {
+		t.Fatalf("expected first request from a to be allowed")
+	}
+	if !rl.Allow(b) {
+		t.Fatalf("expected a's exhausted bucket not to affect b")
+	}
+}
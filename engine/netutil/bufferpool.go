@@ -0,0 +1,109 @@
+package netutil
+
+import "sync"
+
+// BufferPool supplies reusable byte slices for the hot compress/decompress
+// paths of a PacketConnection, similar in spirit to grpc-go's shared buffer
+// pool: callers that would otherwise allocate a fresh []byte per packet can
+// instead Get one sized at least size bytes and Put it back once done.
+//
+// Scope: this pools the codec scratch buffers used by compressPacket and
+// decompressPacket only. It does not back the Packet body itself (the
+// []byte a Packet's payload lives in): that allocation and its lifetime are
+// owned by Packet's own NewPacket/allocPacket/assureCapacity/Release, which
+// do not draw from a BufferPool. Pooling Packet bodies across
+// RecvPacket/SendPacket would require those to source/return storage via a
+// BufferPool too.
+type BufferPool interface {
+	// Get returns a []byte with length size. The returned slice may have
+	// extra capacity; callers should not rely on cap(buf) == size.
+	Get(size int) []byte
+	// Put returns buf to the pool for reuse. Callers must not use buf after
+	// calling Put.
+	Put(buf []byte)
+}
+
+// _BUFFER_POOL_MIN_SIZE is the smallest bucket size; requests smaller than
+// this still round up to it to keep the number of buckets manageable.
+const _BUFFER_POOL_MIN_SIZE = 512
+
+// sizeClassBufferPool is the default BufferPool: a sync.Pool per power-of-two
+// size class between _BUFFER_POOL_MIN_SIZE and _MAX_PACKET_SIZE.
+type sizeClassBufferPool struct {
+	pools []sync.Pool // pools[i] serves buffers of size classSize(i)
+}
+
+// NewSizeClassBufferPool creates a BufferPool bucketed by power-of-two size
+// classes, which is what PacketConnection uses by default.
+func NewSizeClassBufferPool() BufferPool {
+	numClasses := 0
+	for size := _BUFFER_POOL_MIN_SIZE; size < _MAX_PACKET_SIZE; size <<= 1 {
+		numClasses++
+	}
+	numClasses++ // one more for the top class covering up to _MAX_PACKET_SIZE
+
+	p := &sizeClassBufferPool{pools: make([]sync.Pool, numClasses)}
+	for i := range p.pools {
+		classSize := p.classSize(i)
+		p.pools[i].New = func() interface{} {
+			return make([]byte, classSize)
+		}
+	}
+	return p
+}
+
+// classSize is _BUFFER_POOL_MIN_SIZE<<i, except that the top class is capped
+// at _MAX_PACKET_SIZE.
+func (p *sizeClassBufferPool) classSize(i int) int {
+	size := _BUFFER_POOL_MIN_SIZE << uint(i)
+	if size > _MAX_PACKET_SIZE {
+		size = _MAX_PACKET_SIZE
+	}
+	return size
+}
+
+func (p *sizeClassBufferPool) classIndex(size int) int {
+	classSize := _BUFFER_POOL_MIN_SIZE
+	for i := range p.pools {
+		if classSize >= size {
+			return i
+		}
+		classSize <<= 1
+	}
+	return len(p.pools) - 1
+}
+
+func (p *sizeClassBufferPool) Get(size int) []byte {
+	i := p.classIndex(size)
+	buf := p.pools[i].Get().([]byte)
+	if cap(buf) < size {
+		// top class still too small for this request (size > _MAX_PACKET_SIZE);
+		// allocate directly rather than growing the pool's bucket size.
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
+
+func (p *sizeClassBufferPool) Put(buf []byte) {
+	i := p.classIndex(cap(buf))
+	if p.classSize(i) != cap(buf) {
+		// not one of our bucket sizes (e.g. an oversize buffer allocated
+		// directly in Get), don't pool it
+		return
+	}
+	p.pools[i].Put(buf[:cap(buf)])
+}
+
+// defaultBufferPool is shared by PacketConnections that never call
+// SetBufferPool, so unrelated connections still benefit from pooling.
+var defaultBufferPool = NewSizeClassBufferPool()
+
+// SetBufferPool overrides the BufferPool used for this connection's
+// compress/decompress scratch buffers. Pass nil to revert to the shared
+// default pool.
+func (pc *PacketConnection) SetBufferPool(pool BufferPool) {
+	if pool == nil {
+		pool = defaultBufferPool
+	}
+	pc.bufferPool = pool
+}
@@ -0,0 +1,36 @@
+package netutil
+
+import "testing"
+
+func TestSizeClassBufferPoolGetSize(t *testing.T) {
+	pool := NewSizeClassBufferPool()
+	for _, size := range []int{0, 1, 511, 512, 513, 1000, 1 << 20} {
+		buf := pool.Get(size)
+		if len(buf) != size {
+			t.Fatalf("Get(%d) returned a slice of length %d", size, len(buf))
+		}
+	}
+}
+
+func TestSizeClassBufferPoolReusesBuckets(t *testing.T) {
+	pool := NewSizeClassBufferPool().(*sizeClassBufferPool)
+
+	buf := pool.Get(1000)
+	cap1000 := cap(buf)
+	pool.Put(buf)
+
+	reused := pool.Get(900) // rounds up to the same bucket as 1000
+	if cap(reused) != cap1000 {
+		t.Fatalf("expected a request for a nearby size to land in the same bucket: got cap %d, want %d", cap(reused), cap1000)
+	}
+}
+
+func TestSizeClassBufferPoolOversizeFallsBackToDirectAlloc(t *testing.T) {
+	pool := NewSizeClassBufferPool()
+	buf := pool.Get(_MAX_PACKET_SIZE + 1)
+	if len(buf) != _MAX_PACKET_SIZE+1 {
+		t.Fatalf("oversize Get returned length %d, want %d", len(buf), _MAX_PACKET_SIZE+1)
+	}
+	// Put on an oversize buffer must not panic and must not be pooled.
+	pool.Put(buf)
+}
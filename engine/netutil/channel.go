@@ -0,0 +1,172 @@
+package netutil
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/xiaonanln/goworld/engine/gwlog"
+)
+
+// ChannelID identifies one of the multiplexed channels of a PacketConnection.
+// DefaultChannelID is used by SendPacket/RecvPacket for callers that do not
+// care about channel multiplexing.
+type ChannelID = uint8
+
+// DefaultChannelID is the channel used by SendPacket and assumed by RecvPacket
+// callers that never registered any channel of their own.
+const DefaultChannelID ChannelID = 0
+
+// ChannelDescriptor configures one channel of a PacketConnection, following
+// the MConnection channel model: channels are prioritized relative to each
+// other and bound in how much they may queue.
+type ChannelDescriptor struct {
+	// Priority controls how many packets are drained from this channel per
+	// round of the weighted-round-robin Flush scheduler, relative to other
+	// channels. Channels with priority <= 0 are treated as priority 1.
+	Priority int
+	// SendQueueCapacity bounds how many unsent packets may be queued on this
+	// channel; SendPacketOnChannel fails once the queue is full. <= 0 means
+	// unbounded.
+	SendQueueCapacity int
+	// RecvBufferCapacity is advisory buffering hint for the receive side of
+	// this channel; currently unused by PacketConnection itself and left for
+	// higher-level dispatchers that batch received packets per channel.
+	RecvBufferCapacity int
+	// RecvMessageCapacity bounds the size of a single incoming packet on this
+	// channel. RecvPacket fails fast (closing the connection) if a peer
+	// claims a payload larger than this. <= 0 means _MAX_PAYLOAD_LENGTH.
+	RecvMessageCapacity uint32
+}
+
+// channelQueue is the per-channel FIFO of packets waiting to be flushed.
+type channelQueue struct {
+	desc    ChannelDescriptor
+	lock    sync.Mutex
+	packets []*Packet
+}
+
+// chanPacket pairs a queued packet with the channel it was sent on, since
+// channel membership is otherwise lost once packets are merged for Flush.
+type chanPacket struct {
+	channel ChannelID
+	packet  *Packet
+}
+
+// RegisterChannel configures (or reconfigures) a channel. It is safe to call
+// before or after packets have been sent/received on the channel; packets
+// already queued keep their existing priority treatment until the next Flush.
+func (pc *PacketConnection) RegisterChannel(id ChannelID, desc ChannelDescriptor) {
+	if desc.Priority <= 0 {
+		desc.Priority = 1
+	}
+
+	pc.channelsLock.Lock()
+	defer pc.channelsLock.Unlock()
+	if pc.channels == nil {
+		pc.channels = map[ChannelID]*channelQueue{}
+	}
+	if cq, ok := pc.channels[id]; ok {
+		cq.desc = desc
+		return
+	}
+	pc.channels[id] = &channelQueue{desc: desc}
+	pc.channelOrder = append(pc.channelOrder, id)
+}
+
+// channelQueueFor returns the queue for id, creating it with a default
+// (unbounded, priority 1) descriptor if it was never registered.
+func (pc *PacketConnection) channelQueueFor(id ChannelID) *channelQueue {
+	pc.channelsLock.Lock()
+	defer pc.channelsLock.Unlock()
+	if pc.channels == nil {
+		pc.channels = map[ChannelID]*channelQueue{}
+	}
+	cq, ok := pc.channels[id]
+	if !ok {
+		cq = &channelQueue{desc: ChannelDescriptor{Priority: 1}}
+		pc.channels[id] = cq
+		pc.channelOrder = append(pc.channelOrder, id)
+	}
+	return cq
+}
+
+// SendPacketOnChannel queues packet for sending on the given channel. Packets
+// on different channels are interleaved by Flush according to each channel's
+// ChannelDescriptor.Priority, so latency-sensitive traffic need not wait
+// behind bulk traffic queued on another channel.
+func (pc *PacketConnection) SendPacketOnChannel(id ChannelID, packet *Packet) error {
+	if atomic.LoadInt64(&packet.refcount) <= 0 {
+		gwlog.Panicf("sending packet with refcount=%d", packet.refcount)
+	}
+
+	cq := pc.channelQueueFor(id)
+	cq.lock.Lock()
+	if cq.desc.SendQueueCapacity > 0 && len(cq.packets) >= cq.desc.SendQueueCapacity {
+		cq.lock.Unlock()
+		return errors.Errorf("%s: send queue full on channel %d", pc, id)
+	}
+	packet.AddRefCount(1)
+	cq.packets = append(cq.packets, packet)
+	cq.lock.Unlock()
+	return nil
+}
+
+// drainChannelsWRR removes all currently queued packets from every channel,
+// interleaved in weighted-round-robin order by descriptor priority, and
+// returns them in the order Flush should write them to the wire.
+func (pc *PacketConnection) drainChannelsWRR() []chanPacket {
+	pc.channelsLock.Lock()
+	order := make([]ChannelID, len(pc.channelOrder))
+	copy(order, pc.channelOrder)
+	queues := make([]*channelQueue, len(order))
+	for i, id := range order {
+		queues[i] = pc.channels[id]
+	}
+	pc.channelsLock.Unlock()
+
+	var result []chanPacket
+	for {
+		progressed := false
+		for i, cq := range queues {
+			cq.lock.Lock()
+			n := cq.desc.Priority
+			for j := 0; j < n && len(cq.packets) > 0; j++ {
+				result = append(result, chanPacket{channel: order[i], packet: cq.packets[0]})
+				cq.packets = cq.packets[1:]
+				progressed = true
+			}
+			cq.lock.Unlock()
+		}
+		if !progressed {
+			break
+		}
+	}
+	return result
+}
+
+// setChannelID stamps packet's header byte with the channel it is being sent
+// on, so the receiver can route it after RecvPacket.
+func (pc *PacketConnection) setChannelID(packet *Packet, id ChannelID) {
+	packet.bytes[_SIZE_FIELD_SIZE] = id
+}
+
+// recvMessageCapacity returns the configured RecvMessageCapacity for id, or
+// _MAX_PAYLOAD_LENGTH if the channel was never registered or left at 0.
+func (pc *PacketConnection) recvMessageCapacity(id ChannelID) uint32 {
+	pc.channelsLock.Lock()
+	cq, ok := pc.channels[id]
+	pc.channelsLock.Unlock()
+	if !ok || cq.desc.RecvMessageCapacity <= 0 {
+		return _MAX_PAYLOAD_LENGTH
+	}
+	return cq.desc.RecvMessageCapacity
+}
+
+// RecvPacketOnChannel is the channel-aware counterpart of RecvPacket,
+// returning which channel the packet was sent on so callers can dispatch it
+// accordingly.
+func (pc *PacketConnection) RecvPacketOnChannel() (ChannelID, *Packet, error) {
+	packet, err := pc.RecvPacket()
+	return pc.lastRecvChannel, packet, err
+}
@@ -0,0 +1,95 @@
+package netutil
+
+import "testing"
+
+// pushRaw queues n placeholder packets directly onto id's channel queue,
+// bypassing SendPacketOnChannel (which needs a real *Packet to bump its
+// refcount); drainChannelsWRR never dereferences the packets it drains, only
+// reorders them, so nil stand-ins are enough to test priority interleaving.
+func pushRaw(pc *PacketConnection, id ChannelID, n int) {
+	cq := pc.channelQueueFor(id)
+	cq.lock.Lock()
+	for i := 0; i < n; i++ {
+		cq.packets = append(cq.packets, nil)
+	}
+	cq.lock.Unlock()
+}
+
+func TestDrainChannelsWRRInterleavesByPriority(t *testing.T) {
+	pc := &PacketConnection{}
+	pc.RegisterChannel(1, ChannelDescriptor{Priority: 1})
+	pc.RegisterChannel(2, ChannelDescriptor{Priority: 2})
+
+	pushRaw(pc, 1, 2)
+	pushRaw(pc, 2, 4)
+
+	items := pc.drainChannelsWRR()
+	if len(items) != 6 {
+		t.Fatalf("expected 6 drained packets, got %d", len(items))
+	}
+
+	// channel 2 has double the priority of channel 1, so it should get two
+	// packets out for every one of channel 1's, in round order; each round
+	// visits channels in registration order, so channel 1 leads every round.
+	wantChannels := []ChannelID{1, 2, 2, 1, 2, 2}
+	for i, want := range wantChannels {
+		if items[i].channel != want {
+			t.Fatalf("item %d: channel = %d, want %d (full order %v)", i, items[i].channel, want, channelsOf(items))
+		}
+	}
+}
+
+func channelsOf(items []chanPacket) []ChannelID {
+	out := make([]ChannelID, len(items))
+	for i, it := range items {
+		out[i] = it.channel
+	}
+	return out
+}
+
+func TestDrainChannelsWRRDrainsQueuesEmpty(t *testing.T) {
+	pc := &PacketConnection{}
+	pc.RegisterChannel(1, ChannelDescriptor{})
+	pushRaw(pc, 1, 3)
+
+	first := pc.drainChannelsWRR()
+	if len(first) != 3 {
+		t.Fatalf("expected 3 packets on first drain, got %d", len(first))
+	}
+	second := pc.drainChannelsWRR()
+	if len(second) != 0 {
+		t.Fatalf("expected drain to be empty once queues are emptied, got %d", len(second))
+	}
+}
+
+func TestRecvMessageCapacityDefaultsToMaxPayloadLength(t *testing.T) {
+	pc := &PacketConnection{}
+	if got := pc.recvMessageCapacity(5); got != _MAX_PAYLOAD_LENGTH {
+		t.Fatalf("unregistered channel capacity = %d, want %d", got, _MAX_PAYLOAD_LENGTH)
+	}
+}
+
+func TestRecvMessageCapacityHonorsRegisteredChannel(t *testing.T) {
+	pc := &PacketConnection{}
+	pc.RegisterChannel(3, ChannelDescriptor{RecvMessageCapacity: 4096})
+	if got := pc.recvMessageCapacity(3); got != 4096 {
+		t.Fatalf("registered channel capacity = %d, want 4096", got)
+	}
+	// a RecvMessageCapacity of 0 (the zero value) falls back to the default,
+	// same as never registering the channel at all.
+	pc.RegisterChannel(4, ChannelDescriptor{})
+	if got := pc.recvMessageCapacity(4); got != _MAX_PAYLOAD_LENGTH {
+		t.Fatalf("zero-capacity channel = %d, want %d", got, _MAX_PAYLOAD_LENGTH)
+	}
+}
+
+func TestRegisterChannelNonPositivePriorityDefaultsToOne(t *testing.T) {
+	pc := &PacketConnection{}
+	pc.RegisterChannel(1, ChannelDescriptor{Priority: 0})
+	pc.channelsLock.Lock()
+	got := pc.channels[1].desc.Priority
+	pc.channelsLock.Unlock()
+	if got != 1 {
+		t.Fatalf("Priority = %d, want 1", got)
+	}
+}
@@ -0,0 +1,382 @@
+package netutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/s2"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+	"github.com/xiaonanln/goworld/engine/gwlog"
+)
+
+// Codec IDs occupy the _CODEC_ID_BITS bits of the packet size field just below
+// its top (compressed) bit (see _CODEC_ID_MASK in PacketConnection.go), so
+// there is room for at most 16 codecs.
+const (
+	CodecIDFlate  uint8 = 0
+	CodecIDSnappy uint8 = 1
+	CodecIDLZ4    uint8 = 2
+	CodecIDS2     uint8 = 3
+)
+
+// CompressionCodec compresses and decompresses packet payloads. Implementations
+// must be safe for concurrent use since a single PacketConnection's codec may be
+// shared by the send and receive paths.
+type CompressionCodec interface {
+	// Compress returns the compressed form of src. dst (which may be nil) is
+	// scratch storage whose capacity the result may reuse; implementations may
+	// write over it from index 0, so callers pass it with length 0.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress returns the decompressed form of src, reusing dst (which may
+	// be nil) the same way Compress does. Implementations must stop and return an
+	// error as soon as the decompressed size would exceed maxLen, rather than
+	// fully expanding src first and checking the result afterwards, so a
+	// small compressed packet cannot be used to force an arbitrarily large
+	// allocation/decode (a decompression bomb).
+	Decompress(dst, src []byte, maxLen int) ([]byte, error)
+	// ID is the on-wire identifier of this codec, stored in the packet header.
+	ID() uint8
+	// Name is the human-readable codec name, used in logs and CompressionOptions.
+	Name() string
+	// MaxCompressedLen returns this codec's worst-case output size for an
+	// srcLen-byte input, e.g. snappy.MaxEncodedLen. compressPacket sizes its
+	// pooled scratch buffer from this so Compress never finds the buffer too
+	// small and falls back to allocating its own.
+	MaxCompressedLen(srcLen int) int
+}
+
+var (
+	codecRegistry   = map[uint8]CompressionCodec{}
+	codecNameToID   = map[string]uint8{}
+	codecRegistryMu sync.RWMutex
+)
+
+// RegisterCodec registers a CompressionCodec so it can be looked up by ID or
+// name. It is normally called from init() of the file implementing the codec.
+func RegisterCodec(codec CompressionCodec) {
+	codecRegistryMu.Lock()
+	defer codecRegistryMu.Unlock()
+	codecRegistry[codec.ID()] = codec
+	codecNameToID[codec.Name()] = codec.ID()
+}
+
+// CodecByID looks up a previously registered codec by its on-wire ID.
+func CodecByID(id uint8) (CompressionCodec, bool) {
+	codecRegistryMu.RLock()
+	defer codecRegistryMu.RUnlock()
+	codec, ok := codecRegistry[id]
+	return codec, ok
+}
+
+// CodecByName looks up a previously registered codec by name, e.g. "flate",
+// "snappy", "lz4" or "s2".
+func CodecByName(name string) (CompressionCodec, bool) {
+	codecRegistryMu.RLock()
+	id, ok := codecNameToID[name]
+	codecRegistryMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return CodecByID(id)
+}
+
+func init() {
+	RegisterCodec(newFlateCodec())
+	RegisterCodec(snappyCodec{})
+	RegisterCodec(lz4Codec{})
+	RegisterCodec(s2Codec{})
+}
+
+// compressPacket compresses packet in place using pc.codec, rewriting its
+// payload and header. If the compressed form is not actually smaller, the
+// packet is left untouched and sent uncompressed.
+func (pc *PacketConnection) compressPacket(packet *Packet) {
+	codec := pc.codec
+	if codec == nil {
+		return
+	}
+
+	payloadLen := packet.GetPayloadLen()
+	if !pc.compression.shouldCompress(payloadLen) {
+		if pc.compression != nil {
+			atomic.AddUint64(&pc.compression.stats.SkippedCount, 1)
+		}
+		return
+	}
+
+	src := packet.bytes[_PREPAYLOAD_SIZE : _PREPAYLOAD_SIZE+payloadLen]
+	scratch := pc.bufferPool.Get(codec.MaxCompressedLen(int(payloadLen)))[:0]
+	compressed, err := codec.Compress(scratch, src)
+	if err != nil {
+		pc.bufferPool.Put(scratch)
+		gwlog.Errorf("%s: compress packet with %s failed: %v", pc, codec.Name(), err)
+		return
+	}
+	defer pc.bufferPool.Put(scratch)
+	pc.compression.recordRatio(payloadLen, uint32(len(compressed)))
+	if uint32(len(compressed)) >= payloadLen {
+		// not worth compressing
+		if pc.compression != nil {
+			atomic.AddUint64(&pc.compression.stats.SkippedCount, 1)
+		}
+		return
+	}
+
+	packet.assureCapacity(uint32(len(compressed)))
+	copy(packet.bytes[_PREPAYLOAD_SIZE:], compressed)
+	packet.setPayloadLenCompressed(uint32(len(compressed)), true)
+	// setPayloadLenCompressed only sets the compressed bit; OR in the codec ID
+	// so the receiver knows which decoder to use.
+	header := NETWORK_ENDIAN.Uint32(packet.bytes[:_SIZE_FIELD_SIZE])
+	header |= uint32(codec.ID()) << _CODEC_ID_SHIFT
+	NETWORK_ENDIAN.PutUint32(packet.bytes[:_SIZE_FIELD_SIZE], header)
+
+	if pc.compression != nil {
+		atomic.AddUint64(&pc.compression.stats.BytesOutRaw, uint64(payloadLen))
+		atomic.AddUint64(&pc.compression.stats.BytesOutCompressed, uint64(len(compressed)))
+		atomic.AddUint64(&pc.compression.stats.CompressedCount, 1)
+	}
+}
+
+// decompressPacket decompresses a fully-received packet in place.
+// compressedLen is the number of compressed payload bytes already stored at
+// packet.bytes[_PREPAYLOAD_SIZE:]. maxLen is the RecvMessageCapacity of the
+// channel the packet arrived on (see recvMessageCapacity): codec.Decompress
+// is required to bound its own work by maxLen (so a small compressed packet
+// can't force decompressing an arbitrarily large payload), and the length
+// check below is a backstop against a codec that did not.
+func (pc *PacketConnection) decompressPacket(packet *Packet, compressedLen uint32, codec CompressionCodec, maxLen uint32) error {
+	compressedPayload := packet.bytes[_PREPAYLOAD_SIZE : _PREPAYLOAD_SIZE+compressedLen]
+	scratch := pc.bufferPool.Get(int(compressedLen) * 4)[:0]
+	decompressed, err := codec.Decompress(scratch, compressedPayload, int(maxLen))
+	if err != nil {
+		pc.bufferPool.Put(scratch)
+		return errors.Wrapf(err, "decompress packet with %s failed", codec.Name())
+	}
+	defer pc.bufferPool.Put(scratch)
+	if uint32(len(decompressed)) > maxLen {
+		return errors.Errorf("decompressed payload length %v exceeds capacity %v", len(decompressed), maxLen)
+	}
+
+	packet.assureCapacity(uint32(len(decompressed)))
+	copy(packet.bytes[_PREPAYLOAD_SIZE:], decompressed)
+	packet.setPayloadLenCompressed(uint32(len(decompressed)), false)
+
+	if pc.compression != nil {
+		atomic.AddUint64(&pc.compression.stats.BytesInCompressed, uint64(compressedLen))
+		atomic.AddUint64(&pc.compression.stats.BytesInRaw, uint64(len(decompressed)))
+	}
+	return nil
+}
+
+// flateCodec implements CompressionCodec using compress/flate, reusing the
+// existing pool of flate writers so behavior matches the previous hard-coded
+// flate-only path.
+type flateCodec struct {
+	readers sync.Pool
+}
+
+func newFlateCodec() *flateCodec {
+	fc := &flateCodec{}
+	fc.readers.New = func() interface{} {
+		return flate.NewReader(bytes.NewReader(nil))
+	}
+	return fc
+}
+
+func (fc *flateCodec) ID() uint8 {
+	return CodecIDFlate
+}
+
+func (fc *flateCodec) Name() string {
+	return "flate"
+}
+
+// MaxCompressedLen returns a conservative bound on deflate's stored-block
+// fallback (used when data does not compress): one 5-byte block header per
+// 65535 bytes of input, plus a few bytes for the final empty block and bit
+// padding (a raw deflate stream carries no checksum).
+func (fc *flateCodec) MaxCompressedLen(srcLen int) int {
+	return srcLen + 5*((srcLen/65535)+1) + 16
+}
+
+func (fc *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	_cw := compressWritersPool.TryGet()
+	var cw *flate.Writer
+	if _cw != nil {
+		cw = _cw.(*flate.Writer)
+		defer compressWritersPool.Put(cw)
+	} else {
+		gwlog.Warnf("flateCodec: fail to get pooled compressor, creating a temporary one")
+		var err error
+		cw, err = flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := bytes.NewBuffer(dst)
+	cw.Reset(buf)
+	if _, err := cw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (fc *flateCodec) Decompress(dst, src []byte, maxLen int) ([]byte, error) {
+	r := fc.readers.Get().(io.ReadCloser)
+	defer fc.readers.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	// flate carries no embedded output size, so cap the copy at maxLen+1:
+	// reading that much successfully proves the real output is too large
+	// without first expanding all of it.
+	if _, err := io.Copy(buf, io.LimitReader(r, int64(maxLen)+1)); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxLen {
+		return nil, errors.Errorf("decompressed payload exceeds capacity %d", maxLen)
+	}
+	return buf.Bytes(), nil
+}
+
+// snappyCodec implements CompressionCodec using github.com/golang/snappy.
+type snappyCodec struct{}
+
+func (snappyCodec) ID() uint8 {
+	return CodecIDSnappy
+}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) MaxCompressedLen(srcLen int) int {
+	return snappy.MaxEncodedLen(srcLen)
+}
+
+func (snappyCodec) Compress(dst, src []byte) ([]byte, error) {
+	return snappy.Encode(dst[:cap(dst)], src), nil
+}
+
+func (snappyCodec) Decompress(dst, src []byte, maxLen int) ([]byte, error) {
+	// snappy's block format embeds the decoded length, so it can be checked
+	// before doing any actual decompression work.
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxLen {
+		return nil, errors.Errorf("decompressed payload length %d exceeds capacity %d", n, maxLen)
+	}
+	return snappy.Decode(dst[:cap(dst)], src)
+}
+
+// lz4Codec implements CompressionCodec using github.com/pierrec/lz4/v4.
+type lz4Codec struct{}
+
+func (lz4Codec) ID() uint8 {
+	return CodecIDLZ4
+}
+
+func (lz4Codec) Name() string {
+	return "lz4"
+}
+
+func (lz4Codec) MaxCompressedLen(srcLen int) int {
+	return lz4.CompressBlockBound(srcLen)
+}
+
+func (lz4Codec) Compress(dst, src []byte) ([]byte, error) {
+	bound := lz4.CompressBlockBound(len(src))
+	buf := dst[:cap(dst)]
+	if len(buf) < bound {
+		buf = make([]byte, bound)
+	}
+	var c lz4.Compressor
+	n, err := c.CompressBlock(src, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (lz4Codec) Decompress(dst, src []byte, maxLen int) ([]byte, error) {
+	// the uncompressed size is not known ahead of time, so grow a scratch
+	// buffer (starting from the caller-supplied one, if any) until it is big
+	// enough to hold the decompressed block, but never past maxLen+1: that
+	// much failing to be enough proves the real output is too large.
+	limit := maxLen + 1
+	buf := dst[:cap(dst)]
+	if len(buf) > limit {
+		buf = buf[:limit]
+	}
+	if len(buf) == 0 {
+		initial := len(src) * 4
+		if initial > limit {
+			initial = limit
+		}
+		buf = make([]byte, initial)
+	}
+	for {
+		n, err := lz4.UncompressBlock(src, buf)
+		if err == nil {
+			return buf[:n], nil
+		}
+		if err != lz4.ErrInvalidSourceShortBuffer {
+			return nil, err
+		}
+		if len(buf) >= limit {
+			return nil, errors.Errorf("decompressed payload exceeds capacity %d", maxLen)
+		}
+		next := len(buf) * 2
+		if next > limit {
+			next = limit
+		}
+		buf = make([]byte, next)
+	}
+}
+
+// s2Codec implements CompressionCodec using github.com/klauspost/compress/s2,
+// the same codec nats-server uses for route compression.
+type s2Codec struct{}
+
+func (s2Codec) ID() uint8 {
+	return CodecIDS2
+}
+
+func (s2Codec) Name() string {
+	return "s2"
+}
+
+func (s2Codec) MaxCompressedLen(srcLen int) int {
+	return s2.MaxEncodedLen(srcLen)
+}
+
+func (s2Codec) Compress(dst, src []byte) ([]byte, error) {
+	return s2.Encode(dst[:cap(dst)], src), nil
+}
+
+func (s2Codec) Decompress(dst, src []byte, maxLen int) ([]byte, error) {
+	// s2's frame embeds the decoded length, so it can be checked before
+	// doing any actual decompression work.
+	n, err := s2.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxLen {
+		return nil, errors.Errorf("decompressed payload length %d exceeds capacity %d", n, maxLen)
+	}
+	return s2.Decode(dst[:cap(dst)], src)
+}
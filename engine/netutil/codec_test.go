@@ -0,0 +1,86 @@
+package netutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func allCodecs() []CompressionCodec {
+	return []CompressionCodec{
+		newFlateCodec(),
+		snappyCodec{},
+		lz4Codec{},
+		s2Codec{},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		nil,
+		[]byte("x"),
+		bytes.Repeat([]byte("goworld"), 1000),
+		make([]byte, 64*1024), // all-zero, highly compressible
+	}
+
+	for _, codec := range allCodecs() {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			for _, src := range payloads {
+				compressed, err := codec.Compress(nil, src)
+				if err != nil {
+					t.Fatalf("Compress(%d bytes) failed: %v", len(src), err)
+				}
+				decompressed, err := codec.Decompress(nil, compressed, len(src))
+				if err != nil {
+					t.Fatalf("Decompress failed: %v", err)
+				}
+				if !bytes.Equal(decompressed, src) {
+					t.Fatalf("round trip mismatch: got %d bytes, want %d bytes", len(decompressed), len(src))
+				}
+			}
+		})
+	}
+}
+
+func TestCodecMaxCompressedLenIsSufficient(t *testing.T) {
+	// mostly-incompressible pseudo-random bytes (a fixed LCG, so the test is deterministic)
+	src := make([]byte, 30000)
+	x := uint32(1)
+	for i := range src {
+		x = x*1664525 + 1013904223
+		src[i] = byte(x >> 24)
+	}
+	for _, codec := range allCodecs() {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			bound := codec.MaxCompressedLen(len(src))
+			dst := make([]byte, 0, bound)
+			compressed, err := codec.Compress(dst, src)
+			if err != nil {
+				t.Fatalf("Compress failed: %v", err)
+			}
+			if len(compressed) > bound {
+				t.Fatalf("compressed output %d bytes exceeds MaxCompressedLen bound %d", len(compressed), bound)
+			}
+		})
+	}
+}
+
+// TestCodecDecompressRejectsOversizePayload is a regression test for the
+// decompression-bomb fix: a codec must refuse (not merely flag after fully
+// expanding) a payload whose decompressed size exceeds maxLen.
+func TestCodecDecompressRejectsOversizePayload(t *testing.T) {
+	src := bytes.Repeat([]byte{0}, 1<<20) // 1MiB of zeros compresses tiny
+	for _, codec := range allCodecs() {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			compressed, err := codec.Compress(nil, src)
+			if err != nil {
+				t.Fatalf("Compress failed: %v", err)
+			}
+			if _, err := codec.Decompress(nil, compressed, 1024); err == nil {
+				t.Fatalf("Decompress should have rejected a payload exceeding the 1024-byte cap")
+			}
+		})
+	}
+}
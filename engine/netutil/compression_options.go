@@ -0,0 +1,287 @@
+package netutil
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/xiaonanln/goworld/engine/gwlog"
+)
+
+// CompressionMode selects how a PacketConnection decides whether to compress
+// an outgoing packet, mirroring the modes NATS route connections negotiate
+// for S2 compression.
+type CompressionMode uint8
+
+const (
+	// CompressionOff never compresses outgoing packets.
+	CompressionOff CompressionMode = iota
+	// CompressionAccept decompresses incoming packets but never compresses
+	// outgoing ones, e.g. for a peer that wants to save its own CPU.
+	CompressionAccept
+	// CompressionOn always compresses outgoing packets that requireCompress().
+	CompressionOn
+	// CompressionS2Auto always uses the S2 codec regardless of CompressionOptions.Codecs.
+	CompressionS2Auto
+	// CompressionAdaptive compresses only while the recent compression ratio
+	// justifies the CPU cost; see CompressionOptions.AdaptiveMinRatio.
+	CompressionAdaptive
+	// CompressionThreshold only compresses packets whose payload is at least
+	// CompressionOptions.SizeThreshold bytes.
+	CompressionThreshold
+)
+
+func (m CompressionMode) String() string {
+	switch m {
+	case CompressionOff:
+		return "off"
+	case CompressionAccept:
+		return "accept"
+	case CompressionOn:
+		return "on"
+	case CompressionS2Auto:
+		return "s2_auto"
+	case CompressionAdaptive:
+		return "adaptive"
+	case CompressionThreshold:
+		return "threshold"
+	default:
+		return "unknown"
+	}
+}
+
+// CompressionOptions configures how a PacketConnection created by
+// NewPacketConnectionWithOptions negotiates and applies compression.
+type CompressionOptions struct {
+	Mode CompressionMode
+	// Codecs are the codecs this side is willing to use, in preference order.
+	// Ignored when Mode is CompressionOff or CompressionS2Auto.
+	Codecs []CompressionCodec
+	// SizeThreshold is the minimum payload size (bytes) compressed when Mode
+	// is CompressionThreshold.
+	SizeThreshold uint32
+	// AdaptiveWindow is the number of recent packets used to compute the
+	// moving average compression ratio when Mode is CompressionAdaptive.
+	AdaptiveWindow int
+	// AdaptiveMinRatio is the minimum fraction of bytes that must be saved
+	// (0.1 == 10%) on average over AdaptiveWindow packets to keep compressing.
+	AdaptiveMinRatio float64
+}
+
+// DefaultCompressionOptions returns the options equivalent to the historical
+// "compressed bool" behavior: always compress with flate.
+func DefaultCompressionOptions() CompressionOptions {
+	return CompressionOptions{
+		Mode:   CompressionOn,
+		Codecs: []CompressionCodec{defaultCodec()},
+	}
+}
+
+// CompressionStats carries bytes/packet counters for opmon reporting.
+type CompressionStats struct {
+	BytesOutRaw        uint64
+	BytesOutCompressed uint64
+	BytesInRaw         uint64
+	BytesInCompressed  uint64
+	CompressedCount    uint64
+	SkippedCount       uint64
+}
+
+// compressionState holds the runtime (as opposed to configuration) state used
+// to implement CompressionOptions on a PacketConnection.
+type compressionState struct {
+	opts CompressionOptions
+
+	stats CompressionStats
+
+	// adaptive mode bookkeeping: a small ring buffer of recent ratios
+	adaptiveRatios  []float64
+	adaptiveNext    int
+	adaptiveFilled  int
+	adaptiveEnabled bool // becomes false once the moving average drops below AdaptiveMinRatio
+}
+
+func newCompressionState(opts CompressionOptions) *compressionState {
+	if opts.AdaptiveWindow <= 0 {
+		opts.AdaptiveWindow = 32
+	}
+	return &compressionState{
+		opts:            opts,
+		adaptiveRatios:  make([]float64, opts.AdaptiveWindow),
+		adaptiveEnabled: true,
+	}
+}
+
+// NewPacketConnectionWithOptions creates a PacketConnection governed by
+// CompressionOptions, including adaptive and size-threshold compression
+// modes. Call Handshake after the connection is established (and before any
+// packets are sent) to negotiate the codec with the peer.
+func NewPacketConnectionWithOptions(conn Connection, opts CompressionOptions) *PacketConnection {
+	var codec CompressionCodec
+	switch opts.Mode {
+	case CompressionOff:
+		// no codec
+	case CompressionS2Auto:
+		codec, _ = CodecByID(CodecIDS2)
+	default:
+		if len(opts.Codecs) > 0 {
+			codec = opts.Codecs[0]
+		}
+	}
+
+	pc := NewPacketConnectionWithCodec(conn, codec)
+	pc.compression = newCompressionState(opts)
+	return pc
+}
+
+// handshakeMagic prefixes the compression handshake frame so a peer running
+// an older version without handshake support can be detected (it will not
+// send this magic back and the read will time out / mismatch).
+const handshakeMagic = "GWCH"
+
+// Handshake exchanges supported codecs and compression mode with the peer.
+// It must be called by both sides right after the connection is established,
+// before SendPacket/RecvPacket are used. The negotiated codec becomes the
+// codec used for outgoing packets.
+func (pc *PacketConnection) Handshake() error {
+	if pc.compression == nil {
+		pc.compression = newCompressionState(CompressionOptions{Mode: CompressionOff})
+	}
+	opts := pc.compression.opts
+
+	local := make([]byte, 0, len(opts.Codecs)+2)
+	local = append(local, byte(opts.Mode))
+	local = append(local, byte(len(opts.Codecs)))
+	for _, c := range opts.Codecs {
+		local = append(local, c.ID())
+	}
+
+	frame := append([]byte(handshakeMagic), local...)
+	if err := WriteAll(pc.conn, frame); err != nil {
+		return errors.Wrap(err, "compression handshake send failed")
+	}
+	if err := pc.conn.Flush(); err != nil {
+		return errors.Wrap(err, "compression handshake flush failed")
+	}
+
+	peerHeader := make([]byte, len(handshakeMagic)+2)
+	if err := readFull(pc.conn, peerHeader); err != nil {
+		return errors.Wrap(err, "compression handshake recv failed")
+	}
+	if string(peerHeader[:len(handshakeMagic)]) != handshakeMagic {
+		return errors.Errorf("compression handshake magic mismatch: %v", peerHeader[:len(handshakeMagic)])
+	}
+	peerMode := CompressionMode(peerHeader[len(handshakeMagic)])
+	peerCodecCount := int(peerHeader[len(handshakeMagic)+1])
+
+	peerCodecIDs := make([]byte, peerCodecCount)
+	if peerCodecCount > 0 {
+		if err := readFull(pc.conn, peerCodecIDs); err != nil {
+			return errors.Wrap(err, "compression handshake recv codec list failed")
+		}
+	}
+
+	if peerMode == CompressionOff || opts.Mode == CompressionOff {
+		pc.SetPreferredCodec(nil)
+		return nil
+	}
+
+	if opts.Mode == CompressionS2Auto {
+		// S2Auto's codec is fixed by NewPacketConnectionWithOptions and never
+		// drawn from opts.Codecs (normally left empty for this mode per its
+		// doc comment), so it can't be recovered by intersecting opts.Codecs
+		// against the peer's list below; keep it instead of negotiating.
+		codec, _ := CodecByID(CodecIDS2)
+		pc.SetPreferredCodec(codec)
+		return nil
+	}
+
+	// pick the first local codec (in preference order) that the peer also supports
+	var negotiated CompressionCodec
+	for _, c := range opts.Codecs {
+		for _, id := range peerCodecIDs {
+			if c.ID() == id {
+				negotiated = c
+				break
+			}
+		}
+		if negotiated != nil {
+			break
+		}
+	}
+	pc.SetPreferredCodec(negotiated)
+	return nil
+}
+
+func readFull(conn Connection, buf []byte) error {
+	read := 0
+	for read < len(buf) {
+		n, err := conn.Read(buf[read:])
+		read += n
+		if err != nil && read < len(buf) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompressionStats returns a snapshot of this connection's compression
+// counters, suitable for opmon reporting.
+func (pc *PacketConnection) CompressionStats() CompressionStats {
+	if pc.compression == nil {
+		return CompressionStats{}
+	}
+	return CompressionStats{
+		BytesOutRaw:        atomic.LoadUint64(&pc.compression.stats.BytesOutRaw),
+		BytesOutCompressed: atomic.LoadUint64(&pc.compression.stats.BytesOutCompressed),
+		BytesInRaw:         atomic.LoadUint64(&pc.compression.stats.BytesInRaw),
+		BytesInCompressed:  atomic.LoadUint64(&pc.compression.stats.BytesInCompressed),
+		CompressedCount:    atomic.LoadUint64(&pc.compression.stats.CompressedCount),
+		SkippedCount:       atomic.LoadUint64(&pc.compression.stats.SkippedCount),
+	}
+}
+
+// shouldCompress decides, based on the configured CompressionMode, whether
+// payloadLen bytes should be compressed right now.
+func (cs *compressionState) shouldCompress(payloadLen uint32) bool {
+	if cs == nil {
+		return true // no options configured: preserve legacy always-compress behavior
+	}
+	switch cs.opts.Mode {
+	case CompressionOff, CompressionAccept:
+		return false
+	case CompressionThreshold:
+		return payloadLen >= cs.opts.SizeThreshold
+	case CompressionAdaptive:
+		return cs.adaptiveEnabled
+	default: // CompressionOn, CompressionS2Auto
+		return true
+	}
+}
+
+// recordRatio feeds the outcome of one compression attempt into the adaptive
+// moving average, possibly flipping adaptiveEnabled off.
+func (cs *compressionState) recordRatio(rawLen, compressedLen uint32) {
+	if cs == nil || cs.opts.Mode != CompressionAdaptive || rawLen == 0 {
+		return
+	}
+	saved := 1 - float64(compressedLen)/float64(rawLen)
+	cs.adaptiveRatios[cs.adaptiveNext] = saved
+	cs.adaptiveNext = (cs.adaptiveNext + 1) % len(cs.adaptiveRatios)
+	if cs.adaptiveFilled < len(cs.adaptiveRatios) {
+		cs.adaptiveFilled++
+	}
+	if cs.adaptiveFilled < len(cs.adaptiveRatios) {
+		return // wait for a full window before deciding
+	}
+
+	var sum float64
+	for _, r := range cs.adaptiveRatios {
+		sum += r
+	}
+	avg := sum / float64(len(cs.adaptiveRatios))
+	wasEnabled := cs.adaptiveEnabled
+	cs.adaptiveEnabled = avg >= cs.opts.AdaptiveMinRatio
+	if wasEnabled != cs.adaptiveEnabled {
+		gwlog.Infof("compression adaptive mode: average savings %.1f%%, compressing=%v", avg*100, cs.adaptiveEnabled)
+	}
+}
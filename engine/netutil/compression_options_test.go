@@ -0,0 +1,160 @@
+package netutil
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestCompressionModeString(t *testing.T) {
+	cases := map[CompressionMode]string{
+		CompressionOff:        "off",
+		CompressionAccept:     "accept",
+		CompressionOn:         "on",
+		CompressionS2Auto:     "s2_auto",
+		CompressionAdaptive:   "adaptive",
+		CompressionThreshold:  "threshold",
+		CompressionMode(0xFE): "unknown",
+	}
+	for mode, want := range cases {
+		if got := mode.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestShouldCompressByMode(t *testing.T) {
+	if cs := (*compressionState)(nil); !cs.shouldCompress(100) {
+		t.Fatalf("nil compressionState should preserve legacy always-compress behavior")
+	}
+
+	off := newCompressionState(CompressionOptions{Mode: CompressionOff})
+	if off.shouldCompress(100) {
+		t.Fatalf("CompressionOff must never compress")
+	}
+
+	threshold := newCompressionState(CompressionOptions{Mode: CompressionThreshold, SizeThreshold: 1000})
+	if threshold.shouldCompress(999) {
+		t.Fatalf("payload below SizeThreshold should not compress")
+	}
+	if !threshold.shouldCompress(1000) {
+		t.Fatalf("payload at SizeThreshold should compress")
+	}
+}
+
+func TestRecordRatioDisablesAdaptiveBelowMinRatio(t *testing.T) {
+	cs := newCompressionState(CompressionOptions{Mode: CompressionAdaptive, AdaptiveWindow: 4, AdaptiveMinRatio: 0.5})
+	if !cs.adaptiveEnabled {
+		t.Fatalf("adaptive compression should start enabled")
+	}
+
+	// feed a window of packets that barely save anything (10%), below the 50% min ratio
+	for i := 0; i < 4; i++ {
+		cs.recordRatio(1000, 900)
+	}
+	if cs.adaptiveEnabled {
+		t.Fatalf("adaptive compression should disable once the windowed average savings drop below AdaptiveMinRatio")
+	}
+
+	// now feed a window that saves comfortably more than the min ratio
+	for i := 0; i < 4; i++ {
+		cs.recordRatio(1000, 100)
+	}
+	if !cs.adaptiveEnabled {
+		t.Fatalf("adaptive compression should re-enable once the windowed average savings recover")
+	}
+}
+
+// pipeConnection adapts a net.Conn (from loopbackConns) to this package's
+// Connection interface for in-process Handshake tests; net.Conn has no
+// Flush of its own, so it's a no-op here.
+type pipeConnection struct {
+	net.Conn
+}
+
+func (pipeConnection) Flush() error { return nil }
+
+// loopbackConns returns both ends of a loopback TCP connection. Handshake
+// writes its own frame before reading the peer's, so both ends need a
+// transport that buffers writes; the unbuffered net.Pipe would deadlock.
+func loopbackConns(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	return clientConn, serverConn
+}
+
+func TestHandshakeNegotiatesCommonCodec(t *testing.T) {
+	clientConn, serverConn := loopbackConns(t)
+	client := NewPacketConnectionWithOptions(pipeConnection{clientConn}, CompressionOptions{
+		Mode:   CompressionOn,
+		Codecs: []CompressionCodec{mustCodec(t, CodecIDLZ4), mustCodec(t, CodecIDSnappy)},
+	})
+	server := NewPacketConnectionWithOptions(pipeConnection{serverConn}, CompressionOptions{
+		Mode:   CompressionOn,
+		Codecs: []CompressionCodec{mustCodec(t, CodecIDSnappy), mustCodec(t, CodecIDFlate)},
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() { defer wg.Done(); errs[0] = client.Handshake() }()
+	go func() { defer wg.Done(); errs[1] = server.Handshake() }()
+	wg.Wait()
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("Handshake failed: client=%v server=%v", errs[0], errs[1])
+	}
+	if client.codec == nil || client.codec.ID() != CodecIDSnappy {
+		t.Fatalf("client negotiated codec = %v, want snappy (the only ID both sides advertise)", client.codec)
+	}
+	if server.codec == nil || server.codec.ID() != CodecIDSnappy {
+		t.Fatalf("server negotiated codec = %v, want snappy", server.codec)
+	}
+}
+
+// TestHandshakeS2AutoKeepsItsCodec is a regression test: Handshake used to
+// always negotiate from opts.Codecs, which S2Auto deliberately leaves empty,
+// so it wiped out the S2 codec NewPacketConnectionWithOptions had picked.
+func TestHandshakeS2AutoKeepsItsCodec(t *testing.T) {
+	clientConn, serverConn := loopbackConns(t)
+	client := NewPacketConnectionWithOptions(pipeConnection{clientConn}, CompressionOptions{Mode: CompressionS2Auto})
+	server := NewPacketConnectionWithOptions(pipeConnection{serverConn}, CompressionOptions{Mode: CompressionS2Auto})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() { defer wg.Done(); errs[0] = client.Handshake() }()
+	go func() { defer wg.Done(); errs[1] = server.Handshake() }()
+	wg.Wait()
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("Handshake failed: client=%v server=%v", errs[0], errs[1])
+	}
+	if client.codec == nil || client.codec.ID() != CodecIDS2 {
+		t.Fatalf("client codec after S2Auto handshake = %v, want s2", client.codec)
+	}
+	if server.codec == nil || server.codec.ID() != CodecIDS2 {
+		t.Fatalf("server codec after S2Auto handshake = %v, want s2", server.codec)
+	}
+}
+
+func mustCodec(t *testing.T, id uint8) CompressionCodec {
+	t.Helper()
+	codec, ok := CodecByID(id)
+	if !ok {
+		t.Fatalf("codec %d not registered", id)
+	}
+	return codec
+}
@@ -0,0 +1,181 @@
+package netutil
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xiaonanln/goworld/engine/gwlog"
+)
+
+// MsgTypePing and MsgTypePong are reserved packet msgtypes used internally by
+// PacketConnection's keepalive mechanism. Game logic never sees packets of
+// these msgtypes: RecvPacket intercepts and answers them itself.
+const (
+	MsgTypePing uint16 = 0xFFFE
+	MsgTypePong uint16 = 0xFFFF
+)
+
+const _KEEPALIVE_CHECK_INTERVAL = time.Second
+
+// keepaliveState holds the runtime state backing SetKeepAlive/SetIdleTimeout,
+// following the pattern of dubbo-getty's Connection: lastActiveNano is bumped
+// on every successful send/recv, and a background goroutine pings the peer
+// (and eventually closes the connection) when the link has gone quiet.
+type keepaliveState struct {
+	lastActiveNano int64 // unix nanoseconds, atomic
+	pingSentNano   int64 // unix nanoseconds of the outstanding PING, 0 if none, atomic
+
+	interval time.Duration // send a PING after this much inactivity
+	timeout  time.Duration // close the connection if no PONG/data arrives this long after a PING
+
+	startOnce sync.Once
+	stopCh    chan struct{}
+}
+
+func newKeepaliveState() *keepaliveState {
+	return &keepaliveState{
+		lastActiveNano: time.Now().UnixNano(),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+func (pc *PacketConnection) ensureKeepaliveState() *keepaliveState {
+	if pc.keepalive == nil {
+		pc.keepalive = newKeepaliveState()
+	}
+	return pc.keepalive
+}
+
+// SetKeepAlive enables connection-level keepalive: after interval of no
+// send/recv activity, a PING control packet is sent; if no PONG or other
+// data arrives within timeout of that, the connection is closed. timeout also
+// bounds plain inactivity: the connection is closed once it has been idle for
+// timeout whether or not a PING has been sent, so a timeout shorter than
+// interval closes it before any PING goes out. This lets goworld detect
+// half-open TCP connections (NAT rebinds, silent peer death) without waiting
+// for OS-level TCP keepalive.
+func (pc *PacketConnection) SetKeepAlive(interval, timeout time.Duration) {
+	ks := pc.ensureKeepaliveState()
+	ks.interval = interval
+	ks.timeout = timeout
+	pc.startKeepaliveLoop()
+}
+
+// SetIdleTimeout closes the connection if no send/recv activity (including
+// keepalive PINGs) occurs for d, even if no PING has been sent yet. It sets
+// the same timeout as SetKeepAlive's timeout argument, so whichever of the
+// two is called last decides both the idle bound and the PING reply bound.
+func (pc *PacketConnection) SetIdleTimeout(d time.Duration) {
+	ks := pc.ensureKeepaliveState()
+	ks.timeout = d
+	pc.startKeepaliveLoop()
+}
+
+// GetActive returns the time of the last successful send or recv on this
+// connection, or its creation time if there has been none yet.
+func (pc *PacketConnection) GetActive() time.Time {
+	if pc.keepalive == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, atomic.LoadInt64(&pc.keepalive.lastActiveNano))
+}
+
+func (pc *PacketConnection) markActive() {
+	if pc.keepalive == nil {
+		return
+	}
+	atomic.StoreInt64(&pc.keepalive.lastActiveNano, time.Now().UnixNano())
+}
+
+func (pc *PacketConnection) startKeepaliveLoop() {
+	ks := pc.keepalive
+	ks.startOnce.Do(func() {
+		go pc.keepaliveLoop(ks)
+	})
+}
+
+func (pc *PacketConnection) keepaliveLoop(ks *keepaliveState) {
+	ticker := time.NewTicker(_KEEPALIVE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ks.stopCh:
+			return
+		case <-ticker.C:
+			pc.checkKeepalive(ks)
+		}
+	}
+}
+
+func (pc *PacketConnection) checkKeepalive(ks *keepaliveState) {
+	active := pc.GetActive()
+	idle := time.Since(active)
+
+	if pingSent := atomic.LoadInt64(&ks.pingSentNano); pingSent != 0 {
+		if active.UnixNano() > pingSent {
+			// send/recv activity (not necessarily a PONG) happened after the
+			// PING went out, so the peer is clearly alive; clear it and fall
+			// through to the regular idle checks below instead of closing.
+			atomic.StoreInt64(&ks.pingSentNano, 0)
+		} else if ks.timeout > 0 && time.Since(time.Unix(0, pingSent)) >= ks.timeout {
+			gwlog.Warnf("%s: no PONG within %s after PING, closing connection", pc, ks.timeout)
+			pc.Close()
+			return
+		} else {
+			return // PING already outstanding, wait for it to resolve or time out
+		}
+	}
+
+	if ks.timeout > 0 && idle >= ks.timeout {
+		gwlog.Warnf("%s: idle for %s, closing connection", pc, idle)
+		pc.Close()
+		return
+	}
+
+	if ks.interval > 0 && idle >= ks.interval {
+		pc.sendPing(ks)
+	}
+}
+
+// stopKeepalive stops the background keepalive goroutine, if one was started.
+// Close calls this so the goroutine does not leak past the connection's
+// lifetime.
+func (pc *PacketConnection) stopKeepalive() {
+	if pc.keepalive == nil {
+		return
+	}
+	select {
+	case <-pc.keepalive.stopCh:
+		// already closed
+	default:
+		close(pc.keepalive.stopCh)
+	}
+}
+
+func (pc *PacketConnection) sendPing(ks *keepaliveState) {
+	atomic.StoreInt64(&ks.pingSentNano, time.Now().UnixNano())
+	if err := pc.sendControlPacket(MsgTypePing); err != nil {
+		gwlog.Errorf("%s: send PING failed: %v", pc, err)
+	}
+}
+
+func (pc *PacketConnection) sendPong() {
+	if err := pc.sendControlPacket(MsgTypePong); err != nil {
+		gwlog.Errorf("%s: send PONG failed: %v", pc, err)
+	}
+}
+
+// sendControlPacket queues a PING/PONG packet on the default channel. It does
+// not call Flush itself: Flush is documented as single-goroutine-only, and
+// sendPing/sendPong can run concurrently with whatever goroutine drives the
+// connection's normal Flush loop. Queuing lets that existing flusher drain
+// the control packet along with everything else instead of racing it.
+func (pc *PacketConnection) sendControlPacket(msgtype uint16) error {
+	packet := pc.NewPacket()
+	packet.assureCapacity(2)
+	packetEndian.PutUint16(packet.bytes[_PREPAYLOAD_SIZE:], msgtype)
+	packet.setPayloadLenCompressed(2, false)
+
+	return pc.SendPacket(packet)
+}
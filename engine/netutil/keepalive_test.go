@@ -0,0 +1,83 @@
+package netutil
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closeTrackingConnection records whether Close was called, so keepalive
+// tests can assert on the state-machine's decision without a real socket.
+type closeTrackingConnection struct {
+	discardConnection
+	closed int32
+}
+
+func (c *closeTrackingConnection) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func newTestPacketConnectionWithKeepalive(timeout time.Duration) (*PacketConnection, *closeTrackingConnection, *keepaliveState) {
+	conn := &closeTrackingConnection{}
+	pc := NewPacketConnectionWithCodec(conn, nil)
+	ks := newKeepaliveState()
+	ks.timeout = timeout
+	pc.keepalive = ks
+	return pc, conn, ks
+}
+
+func TestCheckKeepaliveClosesWhenIdleExceedsTimeout(t *testing.T) {
+	pc, conn, ks := newTestPacketConnectionWithKeepalive(10 * time.Millisecond)
+	atomic.StoreInt64(&ks.lastActiveNano, time.Now().Add(-time.Second).UnixNano())
+
+	pc.checkKeepalive(ks)
+
+	if atomic.LoadInt32(&conn.closed) == 0 {
+		t.Fatalf("expected the connection to be closed once idle time exceeds the timeout")
+	}
+}
+
+func TestCheckKeepaliveWaitsOnOutstandingPing(t *testing.T) {
+	pc, conn, ks := newTestPacketConnectionWithKeepalive(time.Hour)
+	atomic.StoreInt64(&ks.pingSentNano, time.Now().UnixNano())
+
+	pc.checkKeepalive(ks)
+
+	if atomic.LoadInt32(&conn.closed) != 0 {
+		t.Fatalf("should not close while a PING is outstanding and its timeout has not elapsed")
+	}
+}
+
+func TestCheckKeepaliveClosesAfterPingTimeoutWithNoActivity(t *testing.T) {
+	pc, conn, ks := newTestPacketConnectionWithKeepalive(10 * time.Millisecond)
+	pingTime := time.Now().Add(-time.Second)
+	atomic.StoreInt64(&ks.pingSentNano, pingTime.UnixNano())
+	atomic.StoreInt64(&ks.lastActiveNano, pingTime.UnixNano()) // no activity since the PING
+
+	pc.checkKeepalive(ks)
+
+	if atomic.LoadInt32(&conn.closed) == 0 {
+		t.Fatalf("expected the connection to be closed: PING outstanding past its timeout with no PONG or data")
+	}
+}
+
+// TestCheckKeepaliveDoesNotCloseOnLateActivityAfterPing is a regression test:
+// checkKeepalive used to close the connection purely on elapsed time since
+// the PING, ignoring ordinary data that arrived (and called markActive)
+// after the PING was sent but before any explicit PONG.
+func TestCheckKeepaliveDoesNotCloseOnLateActivityAfterPing(t *testing.T) {
+	pc, conn, ks := newTestPacketConnectionWithKeepalive(10 * time.Millisecond)
+	pingTime := time.Now().Add(-time.Second)
+	atomic.StoreInt64(&ks.pingSentNano, pingTime.UnixNano())
+	atomic.StoreInt64(&ks.lastActiveNano, time.Now().UnixNano()) // activity after the PING
+
+	pc.checkKeepalive(ks)
+
+	if atomic.LoadInt32(&conn.closed) != 0 {
+		t.Fatalf("should not close: activity arrived after the PING even though no explicit PONG did")
+	}
+	if atomic.LoadInt64(&ks.pingSentNano) != 0 {
+		t.Fatalf("pingSentNano should be cleared once later activity proves the peer is alive")
+	}
+}